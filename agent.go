@@ -0,0 +1,14 @@
+package currently_listening
+
+// Agent is an external scrobbling service that gets notified about
+// now-playing updates and completed listens, following the pattern used by
+// Navidrome's scrobbler agents. Implementations live in the agents
+// subpackage.
+type Agent interface {
+	// Name identifies the agent for logging (e.g. "lastfm", "maloja").
+	Name() string
+	// NowPlaying reports that song has just started playing.
+	NowPlaying(song SetListening) error
+	// Scrobble reports that song finished playing at endedAt.
+	Scrobble(song SetListening, endedAt int64) error
+}
@@ -0,0 +1,10 @@
+// Package agents provides built-in currently_listening.Agent implementations
+// for fanning out now-playing/scrobble events to external services.
+package agents
+
+import "errors"
+
+// ErrRetryLater is returned by an agent when the remote service responded
+// with a 5xx status, signalling that the caller should back off and retry
+// rather than treat the listen as permanently rejected.
+var ErrRetryLater = errors.New("agents: server error, retry later")
@@ -0,0 +1,169 @@
+package agents
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/seanbreckenridge/currently_listening"
+)
+
+const lastFMAPIURL = "https://ws.audioscrobbler.com/2.0/"
+
+// LastFMAgent scrobbles to Last.fm using the auth-token/session-key
+// handshake and MD5-signed API calls described in the Last.fm API docs.
+type LastFMAgent struct {
+	apiKey     string
+	apiSecret  string
+	sessionKey string
+	client     *http.Client
+}
+
+// NewLastFMAgent creates an agent that signs calls with apiKey/apiSecret and
+// authenticates as the user identified by sessionKey (obtained once via
+// GetSession, out of band, and then passed in on every later run).
+func NewLastFMAgent(apiKey, apiSecret, sessionKey string) *LastFMAgent {
+	return &LastFMAgent{apiKey: apiKey, apiSecret: apiSecret, sessionKey: sessionKey, client: &http.Client{}}
+}
+
+func (a *LastFMAgent) Name() string {
+	return "lastfm"
+}
+
+func (a *LastFMAgent) NowPlaying(song currently_listening.SetListening) error {
+	return a.call(map[string]string{
+		"method": "track.updateNowPlaying",
+		"artist": song.Artist,
+		"track":  song.Title,
+		"album":  song.Album,
+	})
+}
+
+func (a *LastFMAgent) Scrobble(song currently_listening.SetListening, endedAt int64) error {
+	return a.call(map[string]string{
+		"method":    "track.scrobble",
+		"artist":    song.Artist,
+		"track":     song.Title,
+		"album":     song.Album,
+		"timestamp": fmt.Sprintf("%d", song.StartedAt),
+	})
+}
+
+// lastFMResponse is only used to inspect the error code on a non-2xx
+// response; on success Last.fm's response body isn't otherwise needed.
+type lastFMResponse struct {
+	Error   int    `json:"error"`
+	Message string `json:"message"`
+}
+
+func (a *LastFMAgent) call(params map[string]string) error {
+	params["api_key"] = a.apiKey
+	params["sk"] = a.sessionKey
+	params["api_sig"] = a.sign(params)
+
+	form := url.Values{}
+	for k, v := range params {
+		form.Set(k, v)
+	}
+	form.Set("format", "json")
+
+	resp, err := a.client.PostForm(lastFMAPIURL, form)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 500 {
+		return ErrRetryLater
+	}
+	if resp.StatusCode != 200 {
+		var parsed lastFMResponse
+		json.NewDecoder(resp.Body).Decode(&parsed)
+		return fmt.Errorf("lastfm: %s (error %d): %s", resp.Status, parsed.Error, parsed.Message)
+	}
+	return nil
+}
+
+// sign computes Last.fm's api_sig: every param (except "format") sorted by
+// key, concatenated as key+value, followed by the shared secret, MD5'd.
+// See https://www.last.fm/api/authspec#8.
+func (a *LastFMAgent) sign(params map[string]string) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		if k == "format" {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	for _, k := range keys {
+		sb.WriteString(k)
+		sb.WriteString(params[k])
+	}
+	sb.WriteString(a.apiSecret)
+
+	sum := md5.Sum([]byte(sb.String()))
+	return hex.EncodeToString(sum[:])
+}
+
+// GetToken requests an unauthorized request token, the first step of
+// Last.fm's desktop auth handshake. The user visits
+// https://www.last.fm/api/auth/?api_key=<apiKey>&token=<token> to authorize
+// it, then GetSession exchanges it for a session key.
+func (a *LastFMAgent) GetToken() (string, error) {
+	params := map[string]string{"method": "auth.getToken", "api_key": a.apiKey}
+	params["api_sig"] = a.sign(params)
+
+	var parsed struct {
+		Token string `json:"token"`
+	}
+	if err := a.get(params, &parsed); err != nil {
+		return "", err
+	}
+	return parsed.Token, nil
+}
+
+// GetSession exchanges a user-authorized token (see GetToken) for a
+// permanent session key to pass to NewLastFMAgent.
+func (a *LastFMAgent) GetSession(token string) (string, error) {
+	params := map[string]string{"method": "auth.getSession", "api_key": a.apiKey, "token": token}
+	params["api_sig"] = a.sign(params)
+
+	var parsed struct {
+		Session struct {
+			Key string `json:"key"`
+		} `json:"session"`
+	}
+	if err := a.get(params, &parsed); err != nil {
+		return "", err
+	}
+	return parsed.Session.Key, nil
+}
+
+func (a *LastFMAgent) get(params map[string]string, out interface{}) error {
+	q := url.Values{}
+	for k, v := range params {
+		q.Set(k, v)
+	}
+	q.Set("format", "json")
+
+	resp, err := a.client.Get(lastFMAPIURL + "?" + q.Encode())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		var parsed lastFMResponse
+		json.NewDecoder(resp.Body).Decode(&parsed)
+		return fmt.Errorf("lastfm: %s (error %d): %s", resp.Status, parsed.Error, parsed.Message)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
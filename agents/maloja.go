@@ -0,0 +1,68 @@
+package agents
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/seanbreckenridge/currently_listening"
+)
+
+// MalojaAgent scrobbles to a self-hosted Maloja instance via its simple
+// newscrobble API. Maloja has no now-playing concept, so NowPlaying is a
+// no-op.
+type MalojaAgent struct {
+	endpoint string // e.g. https://maloja.example.com
+	apiKey   string
+	client   *http.Client
+}
+
+// NewMalojaAgent creates an agent that scrobbles to the Maloja instance at
+// endpoint, authenticating with apiKey.
+func NewMalojaAgent(endpoint, apiKey string) *MalojaAgent {
+	return &MalojaAgent{endpoint: endpoint, apiKey: apiKey, client: &http.Client{}}
+}
+
+func (a *MalojaAgent) Name() string {
+	return "maloja"
+}
+
+func (a *MalojaAgent) NowPlaying(song currently_listening.SetListening) error {
+	return nil
+}
+
+type malojaScrobbleRequest struct {
+	Artist string `json:"artist"`
+	Title  string `json:"title"`
+	Album  string `json:"album,omitempty"`
+	Time   int64  `json:"time"`
+	Key    string `json:"key"`
+}
+
+func (a *MalojaAgent) Scrobble(song currently_listening.SetListening, endedAt int64) error {
+	body, err := json.Marshal(malojaScrobbleRequest{
+		Artist: song.Artist,
+		Title:  song.Title,
+		Album:  song.Album,
+		Time:   song.StartedAt,
+		Key:    a.apiKey,
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := a.client.Post(a.endpoint+"/apis/mlj_1/newscrobble", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 500 {
+		return ErrRetryLater
+	}
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("maloja: newscrobble returned %s", resp.Status)
+	}
+	return nil
+}
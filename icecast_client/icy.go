@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var streamTitleRegex = regexp.MustCompile(`StreamTitle='([^']*)';`)
+
+// fetchIcyStreamTitle connects to an ICY-compatible HTTP stream, requests
+// in-band metadata via the Icy-MetaData header, and returns the first
+// StreamTitle it finds. Used for stations that don't expose status-json.xsl.
+func fetchIcyStreamTitle(streamURL string) (string, error) {
+	req, err := http.NewRequest("GET", streamURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Icy-MetaData", "1")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	metaIntHeader := resp.Header.Get("icy-metaint")
+	if metaIntHeader == "" {
+		return "", fmt.Errorf("server did not return icy-metaint, no in-band metadata available")
+	}
+	metaInt, err := strconv.Atoi(metaIntHeader)
+	if err != nil {
+		return "", fmt.Errorf("invalid icy-metaint %q: %s", metaIntHeader, err.Error())
+	}
+
+	reader := bufio.NewReader(resp.Body)
+
+	// discard the audio bytes preceding the first metadata block
+	if _, err := io.CopyN(io.Discard, reader, int64(metaInt)); err != nil {
+		return "", err
+	}
+
+	lengthByte, err := reader.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	metaLen := int(lengthByte) * 16
+	if metaLen == 0 {
+		return "", fmt.Errorf("empty metadata block, stream may not have a title set")
+	}
+
+	meta := make([]byte, metaLen)
+	if _, err := io.ReadFull(reader, meta); err != nil {
+		return "", err
+	}
+
+	matches := streamTitleRegex.FindStringSubmatch(string(meta))
+	if len(matches) < 2 {
+		return "", fmt.Errorf("no StreamTitle found in metadata block: %q", strings.TrimRight(string(meta), "\x00"))
+	}
+	return matches[1], nil
+}
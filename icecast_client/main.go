@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/seanbreckenridge/currently_listening"
+	"github.com/urfave/cli/v2"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// fetchNowPlaying returns the artist/title currently advertised by the
+// stream, fetching either via Icecast's status-json.xsl (if statusURL is
+// set) or via ICY in-band metadata (if streamURL is set instead).
+func fetchNowPlaying(statusURL string, streamURL string, mount string) (artist string, title string, err error) {
+	if statusURL != "" {
+		resp, err := http.Get(statusURL)
+		if err != nil {
+			return "", "", err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != 200 {
+			return "", "", fmt.Errorf("error fetching %s: %s", statusURL, resp.Status)
+		}
+
+		var status icecastStatusResponse
+		if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+			return "", "", err
+		}
+		sources, err := status.sources()
+		if err != nil {
+			return "", "", err
+		}
+		source := selectSource(sources, mount)
+		if source == nil {
+			return "", "", nil
+		}
+		artist, title := source.artistAndTitle()
+		return artist, title, nil
+	}
+
+	raw, err := fetchIcyStreamTitle(streamURL)
+	if err != nil {
+		return "", "", err
+	}
+	artist, title = splitStreamTitle(raw)
+	return artist, title, nil
+}
+
+func pollIcecast(statusURL string, streamURL string, mount string, offlineFallback string, password string, serverUrl string, debug bool, pollInterval int) {
+	var currentlyPlaying *currently_listening.SetListening
+
+	debugPrint := func(msg string) {
+		if debug {
+			log.Printf("DEBUG: %s\n", msg)
+		}
+	}
+
+	serverRequest := func(body interface{}, path string) error {
+		client := &http.Client{}
+		var bodyBytes []byte
+		if body == nil {
+			bodyBytes = []byte("{}")
+		} else {
+			marshalledBytes, err := json.Marshal(body)
+			if err != nil {
+				return err
+			}
+			bodyBytes = marshalledBytes
+		}
+		req, err := http.NewRequest("POST", fmt.Sprintf("%s/%s", serverUrl, path), ioutil.NopCloser(bytes.NewReader(bodyBytes)))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("password", password)
+		resp, err := client.Do(req)
+		if err != nil {
+			log.Fatalf("Error sending %s to server: %s\n", path, err.Error())
+		}
+		if resp.StatusCode != 200 {
+			fmt.Fprintf(os.Stderr, "Error sending %s to server: %s\n", path, resp.Status)
+		}
+		defer resp.Body.Close()
+		serverResp, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			log.Fatalf("Error reading response from server: %s", err.Error())
+		}
+		debugPrint(fmt.Sprintf("Response from server: %s", string(serverResp)))
+		return nil
+	}
+
+	sleep := func() {
+		time.Sleep(time.Duration(pollInterval) * time.Second)
+	}
+
+	// clearIfPlaying returns true if it sent a clear-listening request.
+	clearIfPlaying := func(reason string) bool {
+		if currentlyPlaying == nil {
+			return false
+		}
+		fmt.Printf("%s, clearing currently playing song\n", reason)
+		err := serverRequest(currently_listening.ClearListening{
+			EndedAt: time.Now().Unix(),
+		}, "clear-listening")
+		if err != nil {
+			log.Fatalf("Error clearing currently playing song: %s\n", err.Error())
+		}
+		currentlyPlaying = nil
+		return true
+	}
+
+	// setIfChanged returns true if it sent a set-listening request.
+	setIfChanged := func(artist string, title string) bool {
+		if currentlyPlaying != nil && currentlyPlaying.Artist == artist && currentlyPlaying.Title == title {
+			debugPrint("Now playing has not changed, skipping")
+			return false
+		}
+		fmt.Printf("Now playing changed, setting to Artist: '%s', Title: '%s'\n", artist, title)
+		currentlyPlaying = &currently_listening.SetListening{
+			Artist:         artist,
+			Title:          title,
+			StartedAt:      time.Now().Unix(),
+			Source:         "icecast",
+			SourceInstance: mount,
+		}
+		if err := serverRequest(&currentlyPlaying, "set-listening"); err != nil {
+			log.Fatalf("Error setting currently playing song: %s\n", err.Error())
+		}
+		return true
+	}
+
+	for {
+		artist, title, err := fetchNowPlaying(statusURL, streamURL, mount)
+		sentRequest := false
+		switch {
+		case err != nil:
+			fmt.Printf("Error fetching stream metadata: %s\n", err.Error())
+			if offlineFallback != "" {
+				sentRequest = setIfChanged("", offlineFallback)
+			} else {
+				sentRequest = clearIfPlaying("Stream appears to be offline")
+			}
+		case title == "":
+			sentRequest = clearIfPlaying("Stream is online but not advertising a title")
+		default:
+			sentRequest = setIfChanged(artist, title)
+		}
+
+		// heartbeat independent of whether the song changed, so a long-playing
+		// song doesn't let the server's SourceRegistry expire this source. Skip
+		// it if we already sent a set-listening request this tick, since that
+		// refreshes the registry itself, and after a clear-listening nothing is
+		// playing, so there's no registration to keep alive.
+		if !sentRequest && currentlyPlaying != nil {
+			if err := serverRequest(currently_listening.SourceHeartbeat{Source: "icecast", SourceInstance: mount}, "source-heartbeat"); err != nil {
+				fmt.Printf("Error sending source heartbeat: %s\n", err.Error())
+			}
+		}
+
+		sleep()
+	}
+}
+
+func main() {
+	app := &cli.App{
+		Name:  "icecast_client",
+		Usage: "Poll an Icecast/Shoutcast stream for now-playing metadata",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     "password",
+				Value:    "",
+				Usage:    "Password to authenticate setting the currently playing song",
+				Required: true,
+				EnvVars:  []string{"CURRENTLY_LISTENING_PASSWORD"},
+			},
+			&cli.StringFlag{
+				Name:  "status-url",
+				Value: "",
+				Usage: "URL of the Icecast status-json.xsl endpoint to poll (e.g. https://stream.example.com/status-json.xsl)",
+			},
+			&cli.StringFlag{
+				Name:  "stream-url",
+				Value: "",
+				Usage: "URL of the raw stream to read ICY StreamTitle metadata from, used instead of --status-url",
+			},
+			&cli.StringFlag{
+				Name:  "mount",
+				Value: "",
+				Usage: "Mount point to select when the server has more than one source; defaults to the first source",
+			},
+			&cli.StringFlag{
+				Name:  "offline-fallback",
+				Value: "",
+				Usage: "Title to report while the stream is offline/unreachable. If unset, the currently playing song is cleared instead",
+			},
+			&cli.StringFlag{
+				Name:  "server-url",
+				Value: "http://localhost:3030",
+				Usage: "URL of the server to send the currently playing song to",
+			},
+			&cli.IntFlag{
+				Name:  "poll-interval",
+				Value: 30,
+				Usage: "Interval in seconds to poll the stream for now-playing metadata",
+			},
+			&cli.BoolFlag{
+				Name:  "debug",
+				Value: false,
+				Usage: "Enable debug logging",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			statusURL := c.String("status-url")
+			streamURL := c.String("stream-url")
+			if statusURL == "" && streamURL == "" {
+				return fmt.Errorf("one of --status-url or --stream-url is required")
+			}
+			pollIcecast(statusURL, streamURL, c.String("mount"), c.String("offline-fallback"), c.String("password"), c.String("server-url"), c.Bool("debug"), c.Int("poll-interval"))
+			return nil
+		},
+	}
+
+	if err := app.Run(os.Args); err != nil {
+		log.Fatal(err)
+	}
+}
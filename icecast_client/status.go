@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// icecastStatusResponse mirrors the shape of Icecast's status-json.xsl
+// endpoint. `source` is an object when the server has exactly one mount,
+// and an array when it has more than one, so it's decoded lazily below.
+type icecastStatusResponse struct {
+	Icestats struct {
+		Source json.RawMessage `json:"source"`
+	} `json:"icestats"`
+}
+
+type icecastSource struct {
+	Mount      string `json:"mount"`
+	Artist     string `json:"artist"`
+	Title      string `json:"title"`
+	ServerName string `json:"server_name"`
+}
+
+// sources decodes the `source` field of an Icecast status response,
+// normalizing the single-source and multi-source cases to a slice.
+func (r *icecastStatusResponse) sources() ([]icecastSource, error) {
+	if len(r.Icestats.Source) == 0 {
+		return nil, nil
+	}
+
+	var multi []icecastSource
+	if err := json.Unmarshal(r.Icestats.Source, &multi); err == nil {
+		return multi, nil
+	}
+
+	var single icecastSource
+	if err := json.Unmarshal(r.Icestats.Source, &single); err != nil {
+		return nil, fmt.Errorf("unable to decode icestats.source as an object or array: %w", err)
+	}
+	return []icecastSource{single}, nil
+}
+
+// selectSource picks the source matching mount, or the first source if
+// mount is empty. Returns nil if nothing matches (e.g. all mounts offline).
+func selectSource(sources []icecastSource, mount string) *icecastSource {
+	if len(sources) == 0 {
+		return nil
+	}
+	if mount == "" {
+		return &sources[0]
+	}
+	for i := range sources {
+		if sources[i].Mount == mount {
+			return &sources[i]
+		}
+	}
+	return nil
+}
+
+// artistAndTitle extracts artist/title from a source, splitting the
+// unstructured `title` field on the first " - " when the artist isn't
+// reported separately (common for stations that only set ICY StreamTitle).
+func (s *icecastSource) artistAndTitle() (artist string, title string) {
+	if s.Artist != "" {
+		return s.Artist, s.Title
+	}
+	return splitStreamTitle(s.Title)
+}
+
+// splitStreamTitle splits a "StreamTitle" style string of the form
+// "Artist - Title" on the first " - ". If there's no separator, the whole
+// string is returned as the title with an empty artist.
+func splitStreamTitle(raw string) (artist string, title string) {
+	parts := strings.SplitN(raw, " - ", 2)
+	if len(parts) == 2 {
+		return strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+	}
+	return "", strings.TrimSpace(raw)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestIcecastStatusResponseSourcesSingle(t *testing.T) {
+	var r icecastStatusResponse
+	if err := json.Unmarshal([]byte(`{"icestats":{"source":{"mount":"/main","artist":"A","title":"T"}}}`), &r); err != nil {
+		t.Fatalf("Unmarshal: %s", err.Error())
+	}
+
+	sources, err := r.sources()
+	if err != nil {
+		t.Fatalf("sources: %s", err.Error())
+	}
+	if len(sources) != 1 || sources[0].Mount != "/main" {
+		t.Fatalf("expected a single source for /main, got %+v", sources)
+	}
+}
+
+func TestIcecastStatusResponseSourcesMulti(t *testing.T) {
+	var r icecastStatusResponse
+	if err := json.Unmarshal([]byte(`{"icestats":{"source":[{"mount":"/a"},{"mount":"/b"}]}}`), &r); err != nil {
+		t.Fatalf("Unmarshal: %s", err.Error())
+	}
+
+	sources, err := r.sources()
+	if err != nil {
+		t.Fatalf("sources: %s", err.Error())
+	}
+	if len(sources) != 2 {
+		t.Fatalf("expected 2 sources, got %+v", sources)
+	}
+}
+
+func TestIcecastStatusResponseSourcesEmpty(t *testing.T) {
+	var r icecastStatusResponse
+	if err := json.Unmarshal([]byte(`{"icestats":{}}`), &r); err != nil {
+		t.Fatalf("Unmarshal: %s", err.Error())
+	}
+
+	sources, err := r.sources()
+	if err != nil {
+		t.Fatalf("sources: %s", err.Error())
+	}
+	if sources != nil {
+		t.Fatalf("expected no sources, got %+v", sources)
+	}
+}
+
+func TestSplitStreamTitle(t *testing.T) {
+	cases := []struct {
+		raw           string
+		artist, title string
+	}{
+		{"Artist - Title", "Artist", "Title"},
+		{"Artist - Title - With Dash", "Artist", "Title - With Dash"},
+		{"Just A Title", "", "Just A Title"},
+		{"  Artist  -  Title  ", "Artist", "Title"},
+	}
+	for _, c := range cases {
+		artist, title := splitStreamTitle(c.raw)
+		if artist != c.artist || title != c.title {
+			t.Errorf("splitStreamTitle(%q) = (%q, %q), want (%q, %q)", c.raw, artist, title, c.artist, c.title)
+		}
+	}
+}
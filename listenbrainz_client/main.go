@@ -18,11 +18,30 @@ type ListenBrainzListen struct {
 		Artist_name  string `json:"artist_name"`
 		Track_name   string `json:"track_name"`
 		Release_name string `json:"release_name"`
+		Mbid_mapping struct {
+			Recording_mbid string   `json:"recording_mbid"`
+			Release_mbid   string   `json:"release_mbid"`
+			Artist_mbids   []string `json:"artist_mbids"`
+		} `json:"mbid_mapping"`
 	} `json:"track_metadata"`
 }
 
+// toQueuedListen converts a ListenBrainz "playing-now" listen into the
+// shape submitted back to ListenBrainz as a scrobble/now-playing update.
+func (l *ListenBrainzListen) toQueuedListen(listenedAt int64) QueuedListen {
+	return QueuedListen{
+		Artist:        l.TrackMetadata.Artist_name,
+		Album:         l.TrackMetadata.Release_name,
+		Title:         l.TrackMetadata.Track_name,
+		ListenedAt:    listenedAt,
+		ArtistMBIDs:   l.TrackMetadata.Mbid_mapping.Artist_mbids,
+		RecordingMBID: l.TrackMetadata.Mbid_mapping.Recording_mbid,
+		ReleaseMBID:   l.TrackMetadata.Mbid_mapping.Release_mbid,
+	}
+}
+
 func ListenChanged(c *currently_listening.SetListening, l *ListenBrainzListen) bool {
-	return c.Artist != l.TrackMetadata.Artist_name && c.Album != l.TrackMetadata.Release_name && c.Title != l.TrackMetadata.Track_name
+	return c.Artist != l.TrackMetadata.Artist_name || c.Album != l.TrackMetadata.Release_name || c.Title != l.TrackMetadata.Track_name
 }
 
 type ListenBrainzPayload struct {
@@ -49,9 +68,10 @@ func (p *ListenBrainzResponse) CurrentlyPlaying() *ListenBrainzListen {
 	return nil
 }
 
-func pollListenbrainz(username string, password string, serverUrl string, debug bool, pollInterval int) {
+func pollListenbrainz(username string, password string, serverUrl string, debug bool, pollInterval int, submitter *ListenBrainzSubmitter, queue *ListenQueue) {
 	url := fmt.Sprintf("https://api.listenbrainz.org/1/user/%s/playing-now", username)
 	var currentlyPlaying *currently_listening.SetListening
+	var currentlyPlayingListen *ListenBrainzListen
 
 	debugPrint := func(msg string) {
 		if debug {
@@ -132,11 +152,15 @@ func pollListenbrainz(username string, password string, serverUrl string, debug
 			if err != nil {
 				log.Fatalf("Error clearing currently playing song: %s\n", err.Error())
 			}
+			enqueueFinishedListen(queue, currentlyPlayingListen, currentlyPlaying.StartedAt, debugPrint)
 			currentlyPlaying = nil
+			currentlyPlayingListen = nil
+			flushQueue(submitter, queue, debugPrint)
 			sleep()
 			continue
 		}
 
+		sentSetListening := false
 		if listenbrainzCur := listenbrainzResponse.CurrentlyPlaying(); listenbrainzCur != nil {
 			update := false // if we should send a request
 			// a song is currently playing
@@ -154,24 +178,79 @@ func pollListenbrainz(username string, password string, serverUrl string, debug
 				}
 			}
 			if update {
+				// the previous song, if any, has finished playing -- queue it for submission
+				if currentlyPlaying != nil {
+					enqueueFinishedListen(queue, currentlyPlayingListen, currentlyPlaying.StartedAt, debugPrint)
+				}
+
 				currentlyPlaying = &currently_listening.SetListening{
-					Artist:    listenbrainzCur.TrackMetadata.Artist_name,
-					Album:     listenbrainzCur.TrackMetadata.Release_name,
-					Title:     listenbrainzCur.TrackMetadata.Track_name,
-					StartedAt: time.Now().Unix(),
+					Artist:         listenbrainzCur.TrackMetadata.Artist_name,
+					Album:          listenbrainzCur.TrackMetadata.Release_name,
+					Title:          listenbrainzCur.TrackMetadata.Track_name,
+					StartedAt:      time.Now().Unix(),
+					Source:         "listenbrainz",
+					SourceInstance: username,
 				}
+				currentlyPlayingListen = listenbrainzCur
 
 				// send currently playing song to server
 				err = serverRequest(&currentlyPlaying, "set-listening")
 				if err != nil {
 					log.Fatalf("Error setting currently playing song: %s\n", err.Error())
 				}
+				sentSetListening = true
+
+				if submitter != nil {
+					queued := currentlyPlayingListen.toQueuedListen(currentlyPlaying.StartedAt)
+					if err := submitter.NowPlaying(queued); err != nil {
+						fmt.Printf("Error submitting playing_now to ListenBrainz: %s\n", err.Error())
+					}
+				}
+			}
+		}
+
+		// heartbeat independent of whether the song changed, so a long-playing
+		// song doesn't let the server's SourceRegistry expire this source. Skip
+		// it if we already sent a set-listening request this tick, since that
+		// refreshes the registry itself.
+		if !sentSetListening && currentlyPlaying != nil {
+			if err := serverRequest(currently_listening.SourceHeartbeat{Source: "listenbrainz", SourceInstance: username}, "source-heartbeat"); err != nil {
+				fmt.Printf("Error sending source heartbeat: %s\n", err.Error())
 			}
 		}
+
+		flushQueue(submitter, queue, debugPrint)
 		sleep()
 	}
 }
 
+// enqueueFinishedListen persists the song that just finished playing so it
+// can be submitted to ListenBrainz as a "single" listen, even if the
+// program restarts before the queue is flushed.
+func enqueueFinishedListen(queue *ListenQueue, listen *ListenBrainzListen, listenedAt int64, debugPrint func(string)) {
+	if queue == nil || listen == nil {
+		return
+	}
+	if err := queue.Enqueue(listen.toQueuedListen(listenedAt)); err != nil {
+		fmt.Printf("Error queueing finished listen for ListenBrainz submission: %s\n", err.Error())
+		return
+	}
+	debugPrint("Queued finished listen for ListenBrainz submission")
+}
+
+// flushQueue submits any listens still queued on disk, if a submitter (i.e.
+// a ListenBrainz user token) was configured.
+func flushQueue(submitter *ListenBrainzSubmitter, queue *ListenQueue, debugPrint func(string)) {
+	if submitter == nil || queue == nil {
+		return
+	}
+	if err := submitter.FlushQueue(queue); err != nil {
+		fmt.Printf("Error flushing ListenBrainz submission queue: %s\n", err.Error())
+		return
+	}
+	debugPrint("Flushed ListenBrainz submission queue")
+}
+
 func main() {
 	app := &cli.App{
 		Name:  "listenbrainz_client",
@@ -206,9 +285,26 @@ func main() {
 				Value: false,
 				Usage: "Enable debug logging",
 			},
+			&cli.StringFlag{
+				Name:    "listenbrainz-token",
+				Value:   "",
+				Usage:   "ListenBrainz user token, used to submit scrobbles/playing_now back to ListenBrainz. If unset, this only mirrors to the currently_listening server",
+				EnvVars: []string{"LISTENBRAINZ_TOKEN"},
+			},
+			&cli.StringFlag{
+				Name:  "queue-file",
+				Value: "listenbrainz_queue.json",
+				Usage: "Path to the on-disk queue of listens waiting to be submitted to ListenBrainz",
+			},
 		},
 		Action: func(c *cli.Context) error {
-			pollListenbrainz(c.String("listenbrainz-username"), c.String("password"), c.String("server-url"), c.Bool("debug"), c.Int("poll-interval"))
+			var submitter *ListenBrainzSubmitter
+			var queue *ListenQueue
+			if token := c.String("listenbrainz-token"); token != "" {
+				submitter = NewListenBrainzSubmitter(token, c.Bool("debug"))
+				queue = NewListenQueue(c.String("queue-file"))
+			}
+			pollListenbrainz(c.String("listenbrainz-username"), c.String("password"), c.String("server-url"), c.Bool("debug"), c.Int("poll-interval"), submitter, queue)
 			return nil
 		},
 	}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	submissionClient        = "currently_listening-listenbrainz_client"
+	submissionClientVersion = "0.1.0"
+	listenBrainzSubmitURL   = "https://api.listenbrainz.org/1/submit-listens"
+)
+
+// ErrRetryLater is returned when ListenBrainz responds with a 5xx status or
+// the request could not be sent at all (e.g. the network is down).
+// Callers should back off and try again rather than dropping the listen,
+// following the same convention as Navidrome's scrobbler agents.
+var ErrRetryLater = errors.New("listenbrainz: server error, retry later")
+
+// QueuedListen is a single play waiting to be submitted to ListenBrainz as
+// a "single" listen, persisted to disk so a restart doesn't lose it.
+type QueuedListen struct {
+	Artist        string   `json:"artist"`
+	Album         string   `json:"album"`
+	Title         string   `json:"title"`
+	ListenedAt    int64    `json:"listened_at"`
+	TrackNumber   int      `json:"track_number,omitempty"`
+	ArtistMBIDs   []string `json:"artist_mbids,omitempty"`
+	RecordingMBID string   `json:"recording_mbid,omitempty"`
+	ReleaseMBID   string   `json:"release_mbid,omitempty"`
+}
+
+// ListenQueue is an on-disk, newline-delimited JSON queue of listens that
+// still need to be submitted to ListenBrainz.
+type ListenQueue struct {
+	path string
+	mu   sync.Mutex
+}
+
+func NewListenQueue(path string) *ListenQueue {
+	return &ListenQueue{path: path}
+}
+
+// Enqueue appends a listen to the queue file, creating it if necessary.
+func (q *ListenQueue) Enqueue(l QueuedListen) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	f, err := os.OpenFile(q.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	line, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+// Load reads every listen currently queued on disk.
+func (q *ListenQueue) Load() ([]QueuedListen, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	raw, err := ioutil.ReadFile(q.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var listens []QueuedListen
+	for _, line := range bytes.Split(raw, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var l QueuedListen
+		if err := json.Unmarshal(line, &l); err != nil {
+			return nil, err
+		}
+		listens = append(listens, l)
+	}
+	return listens, nil
+}
+
+// Replace overwrites the queue file with the given listens. Used after a
+// flush to drop whatever was submitted (or permanently rejected).
+func (q *ListenQueue) Replace(listens []QueuedListen) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	f, err := os.Create(q.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for _, l := range listens {
+		line, err := json.Marshal(l)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(append(line, '\n')); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListenBrainzSubmitter submits "playing_now" and "single" listens to the
+// ListenBrainz submit-listens API using a user token.
+type ListenBrainzSubmitter struct {
+	token  string
+	client *http.Client
+	debug  bool
+}
+
+func NewListenBrainzSubmitter(token string, debug bool) *ListenBrainzSubmitter {
+	return &ListenBrainzSubmitter{token: token, client: &http.Client{}, debug: debug}
+}
+
+type submitListenPayload struct {
+	ListenType string         `json:"listen_type"`
+	Payload    []submitListen `json:"payload"`
+}
+
+type submitListen struct {
+	ListenedAt    int64               `json:"listened_at,omitempty"`
+	TrackMetadata submitTrackMetadata `json:"track_metadata"`
+}
+
+type submitTrackMetadata struct {
+	ArtistName     string               `json:"artist_name"`
+	TrackName      string               `json:"track_name"`
+	ReleaseName    string               `json:"release_name,omitempty"`
+	AdditionalInfo submitAdditionalInfo `json:"additional_info"`
+}
+
+type submitAdditionalInfo struct {
+	SubmissionClient        string   `json:"submission_client"`
+	SubmissionClientVersion string   `json:"submission_client_version"`
+	TrackNumber             int      `json:"track_number,omitempty"`
+	ArtistMBIDs             []string `json:"artist_mbids,omitempty"`
+	RecordingMBID           string   `json:"recording_mbid,omitempty"`
+	ReleaseMBID             string   `json:"release_mbid,omitempty"`
+}
+
+func (l QueuedListen) toPayload(listenType string) submitListenPayload {
+	sl := submitListen{
+		TrackMetadata: submitTrackMetadata{
+			ArtistName:  l.Artist,
+			TrackName:   l.Title,
+			ReleaseName: l.Album,
+			AdditionalInfo: submitAdditionalInfo{
+				SubmissionClient:        submissionClient,
+				SubmissionClientVersion: submissionClientVersion,
+				TrackNumber:             l.TrackNumber,
+				ArtistMBIDs:             l.ArtistMBIDs,
+				RecordingMBID:           l.RecordingMBID,
+				ReleaseMBID:             l.ReleaseMBID,
+			},
+		},
+	}
+	if listenType == "single" {
+		sl.ListenedAt = l.ListenedAt
+	}
+	return submitListenPayload{ListenType: listenType, Payload: []submitListen{sl}}
+}
+
+// submit POSTs a payload to ListenBrainz. It returns ErrRetryLater on a 5xx
+// response or a failed request so callers can back off and retry; a 4xx is returned as a plain
+// error, which callers should treat as a permanent rejection.
+func (s *ListenBrainzSubmitter) submit(payload submitListenPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", listenBrainzSubmitURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Token %s", s.token))
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrRetryLater, err.Error())
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	if s.debug {
+		log.Printf("DEBUG: listenbrainz submit (%s) response %s: %s\n", payload.ListenType, resp.Status, string(respBody))
+	}
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode >= 500:
+		return ErrRetryLater
+	default:
+		return fmt.Errorf("listenbrainz rejected submission: %s: %s", resp.Status, string(respBody))
+	}
+}
+
+// NowPlaying submits a "playing_now" notification. These aren't queued or
+// retried: if the submission fails it is dropped, and the next playing_now
+// is only sent once the song changes.
+func (s *ListenBrainzSubmitter) NowPlaying(l QueuedListen) error {
+	return s.submit(l.toPayload("playing_now"))
+}
+
+// submitWithBackoff retries submitFn on ErrRetryLater with exponential
+// backoff, giving up after maxRetries retries (maxRetries+1 attempts in all).
+func submitWithBackoff(submitFn func() error, maxRetries int) error {
+	backoff := time.Second
+	var err error
+	for attempt := 0; attempt <= maxRetries; attempt++ {
+		err = submitFn()
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, ErrRetryLater) {
+			return err
+		}
+		if attempt == maxRetries {
+			break
+		}
+		log.Printf("listenbrainz: server error, retrying in %s\n", backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	return err
+}
+
+// FlushQueue submits every listen currently queued on disk as a "single"
+// listen, dropping ones ListenBrainz rejects outright (4xx) and leaving
+// anything still erroring (5xx, after retries) in the queue for next time.
+func (s *ListenBrainzSubmitter) FlushQueue(q *ListenQueue) error {
+	listens, err := q.Load()
+	if err != nil {
+		return err
+	}
+	if len(listens) == 0 {
+		return nil
+	}
+	var remaining []QueuedListen
+	for _, l := range listens {
+		l := l
+		err := submitWithBackoff(func() error {
+			return s.submit(l.toPayload("single"))
+		}, 5)
+		if err == nil {
+			continue
+		}
+		if errors.Is(err, ErrRetryLater) {
+			log.Printf("listenbrainz: giving up on submitting listen for now, will retry next flush: %+v\n", l)
+			remaining = append(remaining, l)
+			continue
+		}
+		log.Printf("listenbrainz: dropping listen rejected by server: %s\n", err.Error())
+	}
+	return q.Replace(remaining)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestListenQueueLoadMissingFile(t *testing.T) {
+	q := NewListenQueue(filepath.Join(t.TempDir(), "queue.json"))
+
+	listens, err := q.Load()
+	if err != nil {
+		t.Fatalf("Load on a missing queue file should not error, got %s", err.Error())
+	}
+	if len(listens) != 0 {
+		t.Fatalf("expected no listens, got %+v", listens)
+	}
+}
+
+func TestListenQueueEnqueueAndLoad(t *testing.T) {
+	q := NewListenQueue(filepath.Join(t.TempDir(), "queue.json"))
+
+	first := QueuedListen{Artist: "A", Title: "One", ListenedAt: 1}
+	second := QueuedListen{Artist: "B", Title: "Two", ListenedAt: 2}
+
+	if err := q.Enqueue(first); err != nil {
+		t.Fatalf("Enqueue: %s", err.Error())
+	}
+	if err := q.Enqueue(second); err != nil {
+		t.Fatalf("Enqueue: %s", err.Error())
+	}
+
+	listens, err := q.Load()
+	if err != nil {
+		t.Fatalf("Load: %s", err.Error())
+	}
+	if len(listens) != 2 {
+		t.Fatalf("expected 2 queued listens, got %d: %+v", len(listens), listens)
+	}
+	if !reflect.DeepEqual(listens[0], first) || !reflect.DeepEqual(listens[1], second) {
+		t.Fatalf("queued listens out of order or corrupted, got %+v", listens)
+	}
+}
+
+func TestListenQueueReplace(t *testing.T) {
+	q := NewListenQueue(filepath.Join(t.TempDir(), "queue.json"))
+
+	if err := q.Enqueue(QueuedListen{Artist: "A", Title: "One", ListenedAt: 1}); err != nil {
+		t.Fatalf("Enqueue: %s", err.Error())
+	}
+	if err := q.Enqueue(QueuedListen{Artist: "B", Title: "Two", ListenedAt: 2}); err != nil {
+		t.Fatalf("Enqueue: %s", err.Error())
+	}
+
+	remaining := []QueuedListen{{Artist: "B", Title: "Two", ListenedAt: 2}}
+	if err := q.Replace(remaining); err != nil {
+		t.Fatalf("Replace: %s", err.Error())
+	}
+
+	listens, err := q.Load()
+	if err != nil {
+		t.Fatalf("Load: %s", err.Error())
+	}
+	if len(listens) != 1 || !reflect.DeepEqual(listens[0], remaining[0]) {
+		t.Fatalf("expected queue to contain only the replaced listens, got %+v", listens)
+	}
+}
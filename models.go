@@ -7,8 +7,29 @@ type SetListening struct {
 	Title       string `json:"title"`
 	StartedAt   int64  `json:"started_at"`
 	Base64Image string `json:"base64_image"`
+	// CoverURL points at a server-cached cover image (see GET /cover/<hash>.jpg),
+	// populated by the server's cover-art enrichment when a set-listening request
+	// arrives without a Base64Image. Clients that don't understand CoverURL can
+	// keep using Base64Image.
+	CoverURL string `json:"cover_url,omitempty"`
+	// Source identifies what submitted this (e.g. "listenbrainz", "mpris", "browser"),
+	// used by the SourceRegistry to resolve conflicts between simultaneous submitters.
+	Source string `json:"source,omitempty"`
+	// SourceInstance distinguishes multiple instances of the same Source
+	// (e.g. two machines both running the ListenBrainz poller).
+	SourceInstance string `json:"source_instance,omitempty"`
 }
 
 type ClearListening struct {
 	EndedAt int64 `json:"ended_at"`
 }
+
+// SourceHeartbeat keeps a source's SourceRegistry registration alive
+// without implying the song changed. Sources should POST this periodically
+// (independent of whether the currently playing song has changed) so a
+// long-playing song doesn't cause the registry to expire its source and
+// hand authority to a lower-priority one.
+type SourceHeartbeat struct {
+	Source         string `json:"source"`
+	SourceInstance string `json:"source_instance"`
+}
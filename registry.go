@@ -0,0 +1,99 @@
+package currently_listening
+
+import "sync"
+
+// SourceRegistration tracks the last time a given source/instance reported
+// that it was setting the currently-playing song.
+type SourceRegistration struct {
+	Source         string `json:"source"`
+	SourceInstance string `json:"source_instance"`
+	Priority       int    `json:"priority"`
+	LastSeen       int64  `json:"last_seen"`
+}
+
+// key uniquely identifies a source regardless of how many instances of it
+// are running (e.g. two machines both running the ListenBrainz poller).
+func (s SourceRegistration) key() string {
+	return s.Source + "\x00" + s.SourceInstance
+}
+
+// SourceRegistry tracks every source currently submitting plays. When more
+// than one source is active, conflicts are resolved by priority (higher
+// wins, ties broken by whoever reported most recently), and sources that
+// stop heartbeating are expired after ttlSeconds.
+type SourceRegistry struct {
+	mu      sync.Mutex
+	ttl     int64
+	sources map[string]SourceRegistration
+	active  string // key of the source currently considered authoritative
+}
+
+// NewSourceRegistry creates a registry that expires sources which haven't
+// heartbeated in ttlSeconds.
+func NewSourceRegistry(ttlSeconds int64) *SourceRegistry {
+	return &SourceRegistry{ttl: ttlSeconds, sources: make(map[string]SourceRegistration)}
+}
+
+// Heartbeat registers (or updates) a source's last-seen timestamp and
+// reports whether it should be treated as authoritative, i.e. whether
+// whatever it's reporting should actually be applied as the currently
+// playing song.
+//
+// now must be a trustworthy, monotonically-increasing clock (the server's
+// own time.Now().Unix()) — it's used to expire every registered source's
+// TTL and so must never come from caller-supplied data, or a single
+// source with a bogus/skewed timestamp could evict unrelated sources.
+// reportedAt is recorded as this source's own LastSeen and may be
+// caller-supplied: it decides when this one source expires, and while this
+// source is active, an equal-priority source only takes over once `now` has
+// reached it.
+func (r *SourceRegistry) Heartbeat(source, instance string, priority int, now int64, reportedAt int64) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.expireLocked(now)
+
+	reg := SourceRegistration{Source: source, SourceInstance: instance, Priority: priority, LastSeen: reportedAt}
+	key := reg.key()
+	r.sources[key] = reg
+
+	current, ok := r.sources[r.active]
+	if !ok {
+		r.active = key
+		return true
+	}
+	if key == r.active {
+		return true
+	}
+	// higher priority always wins; ties go to whoever reported most recently
+	if priority > current.Priority || (priority == current.Priority && now >= current.LastSeen) {
+		r.active = key
+		return true
+	}
+	return false
+}
+
+// expireLocked drops any source that hasn't heartbeated within the TTL.
+// Callers must hold r.mu.
+func (r *SourceRegistry) expireLocked(now int64) {
+	for key, reg := range r.sources {
+		if now-reg.LastSeen > r.ttl {
+			delete(r.sources, key)
+			if key == r.active {
+				r.active = ""
+			}
+		}
+	}
+}
+
+// Active returns every source the registry has heard from within the TTL.
+func (r *SourceRegistry) Active(now int64) []SourceRegistration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.expireLocked(now)
+	regs := make([]SourceRegistration, 0, len(r.sources))
+	for _, reg := range r.sources {
+		regs = append(regs, reg)
+	}
+	return regs
+}
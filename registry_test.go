@@ -0,0 +1,62 @@
+package currently_listening
+
+import "testing"
+
+func TestSourceRegistryHeartbeatPriority(t *testing.T) {
+	r := NewSourceRegistry(120)
+
+	if active := r.Heartbeat("listenbrainz", "", 10, 0, 0); !active {
+		t.Fatalf("first source to heartbeat should become active")
+	}
+	if active := r.Heartbeat("browser", "", 0, 10, 10); active {
+		t.Fatalf("lower-priority source should not preempt a higher-priority active source")
+	}
+	if active := r.Heartbeat("listenbrainz", "", 10, 20, 20); !active {
+		t.Fatalf("the already-active source should remain active on its own heartbeat")
+	}
+}
+
+func TestSourceRegistryHeartbeatTiesGoToMostRecent(t *testing.T) {
+	r := NewSourceRegistry(120)
+
+	r.Heartbeat("a", "", 5, 0, 0)
+	if active := r.Heartbeat("b", "", 5, 10, 10); !active {
+		t.Fatalf("equal-priority source reporting more recently should become active")
+	}
+}
+
+func TestSourceRegistryBogusReportedAtDoesNotEvictOthers(t *testing.T) {
+	r := NewSourceRegistry(120)
+
+	// listenbrainz (priority 10) is heartbeating normally on the server's
+	// real clock.
+	r.Heartbeat("listenbrainz", "", 10, 0, 0)
+
+	// a lower-priority source reports a wildly bogus/skewed reportedAt
+	// (e.g. milliseconds instead of seconds); the server's own clock,
+	// `now`, must still be used to decide whether listenbrainz has expired.
+	active := r.Heartbeat("browser", "", 0, 10, 1700000000000)
+	if active {
+		t.Fatalf("lower-priority source with a bogus timestamp should not become active")
+	}
+
+	regs := r.Active(10)
+	found := false
+	for _, reg := range regs {
+		if reg.Source == "listenbrainz" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("listenbrainz should not have been evicted by browser's bogus timestamp, got %+v", regs)
+	}
+}
+
+func TestSourceRegistryExpiresOnServerClock(t *testing.T) {
+	r := NewSourceRegistry(120)
+
+	r.Heartbeat("listenbrainz", "", 10, 0, 0)
+	if active := r.Heartbeat("browser", "", 0, 200, 200); !active {
+		t.Fatalf("browser should become active once listenbrainz has genuinely expired on the server clock")
+	}
+}
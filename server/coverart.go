@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	musicBrainzSearchURL  = "https://musicbrainz.org/ws/2/release/"
+	coverArtArchiveURLFmt = "https://coverartarchive.org/release/%s/front-500"
+	// musicBrainzRequestInterval honors MusicBrainz's "no more than one
+	// request per second" rate limit policy.
+	musicBrainzRequestInterval = time.Second
+)
+
+// defaultCoverArtNegativeTTL is how long a failed cover art lookup is
+// remembered before MusicBrainz/CoverArtArchive are queried again.
+const defaultCoverArtNegativeTTL = 24 * time.Hour
+
+// CoverArtFetcher looks up cover art for (artist, album) pairs that weren't
+// submitted with an image, via a MusicBrainz release search followed by a
+// CoverArtArchive fetch, and caches the result on disk.
+type CoverArtFetcher struct {
+	cacheDir    string
+	client      *http.Client
+	negativeTTL time.Duration
+
+	mu          sync.Mutex
+	lastRequest time.Time
+	negative    map[string]time.Time // cache key -> time of last miss
+}
+
+// NewCoverArtFetcher creates a fetcher that caches images under cacheDir
+// and remembers misses for negativeTTL before retrying MusicBrainz/CAA.
+func NewCoverArtFetcher(cacheDir string, negativeTTL time.Duration) (*CoverArtFetcher, error) {
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return nil, err
+	}
+	return &CoverArtFetcher{
+		cacheDir:    cacheDir,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		negativeTTL: negativeTTL,
+		negative:    make(map[string]time.Time),
+	}, nil
+}
+
+// CacheKey returns the stable identifier used for both the on-disk filename
+// and the /cover/<hash>.jpg URL for an (artist, album) pair.
+func (c *CoverArtFetcher) CacheKey(artist, album string) string {
+	sum := sha1.Sum([]byte(artist + "\x00" + album))
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *CoverArtFetcher) cachePath(key string) string {
+	return filepath.Join(c.cacheDir, key+".jpg")
+}
+
+// Path returns the on-disk path for a given cache key, for serving via
+// GET /cover/<hash>.jpg.
+func (c *CoverArtFetcher) Path(key string) string {
+	return c.cachePath(key)
+}
+
+// Fetch returns the cache key for (artist, album)'s cover art, fetching and
+// caching it from MusicBrainz/CoverArtArchive if it isn't already cached.
+// ok is false if no cover art could be found (and the miss has been
+// negatively cached for negativeTTL).
+func (c *CoverArtFetcher) Fetch(artist, album string) (key string, ok bool, err error) {
+	key = c.CacheKey(artist, album)
+
+	if _, err := os.Stat(c.cachePath(key)); err == nil {
+		return key, true, nil
+	}
+
+	if c.isNegativelyCached(key) {
+		return "", false, nil
+	}
+
+	mbid, err := c.lookupReleaseMBID(artist, album)
+	if err != nil {
+		return "", false, err
+	}
+	if mbid == "" {
+		c.setNegativeCache(key)
+		return "", false, nil
+	}
+
+	image, err := c.fetchCoverArtArchive(mbid)
+	if err != nil {
+		return "", false, err
+	}
+	if image == nil {
+		c.setNegativeCache(key)
+		return "", false, nil
+	}
+
+	if err := ioutil.WriteFile(c.cachePath(key), image, 0644); err != nil {
+		return "", false, err
+	}
+	return key, true, nil
+}
+
+func (c *CoverArtFetcher) isNegativelyCached(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	missedAt, ok := c.negative[key]
+	if !ok {
+		return false
+	}
+	if time.Since(missedAt) > c.negativeTTL {
+		delete(c.negative, key)
+		return false
+	}
+	return true
+}
+
+func (c *CoverArtFetcher) setNegativeCache(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.negative[key] = time.Now()
+}
+
+// rateLimit blocks until at least musicBrainzRequestInterval has passed
+// since the last outgoing MusicBrainz/CoverArtArchive request.
+func (c *CoverArtFetcher) rateLimit() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	wait := musicBrainzRequestInterval - time.Since(c.lastRequest)
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+	c.lastRequest = time.Now()
+}
+
+type musicBrainzSearchResponse struct {
+	Releases []struct {
+		ID string `json:"id"`
+	} `json:"releases"`
+}
+
+// lookupReleaseMBID searches MusicBrainz for a release matching artist and
+// album, returning the MBID of the first match, or "" if none was found.
+func (c *CoverArtFetcher) lookupReleaseMBID(artist, album string) (string, error) {
+	c.rateLimit()
+
+	req, err := http.NewRequest("GET", musicBrainzSearchURL, nil)
+	if err != nil {
+		return "", err
+	}
+	q := req.URL.Query()
+	q.Set("query", fmt.Sprintf(`artist:"%s" AND release:"%s"`, artist, album))
+	q.Set("fmt", "json")
+	q.Set("limit", "1")
+	req.URL.RawQuery = q.Encode()
+	req.Header.Set("User-Agent", "currently_listening/0.1 ( https://github.com/seanbreckenridge/currently_listening )")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("musicbrainz search returned %s", resp.Status)
+	}
+
+	var parsed musicBrainzSearchResponse
+	if err := json.NewDecoder(resp.Body).Decode(&parsed); err != nil {
+		return "", err
+	}
+	if len(parsed.Releases) == 0 {
+		return "", nil
+	}
+	return parsed.Releases[0].ID, nil
+}
+
+// fetchCoverArtArchive fetches the front-500 cover image for a release
+// MBID. A 404 (no art for this release) is not an error: it returns
+// (nil, nil) so the caller can negatively cache it.
+func (c *CoverArtFetcher) fetchCoverArtArchive(mbid string) ([]byte, error) {
+	c.rateLimit()
+
+	resp, err := c.client.Get(fmt.Sprintf(coverArtArchiveURLFmt, mbid))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("coverartarchive returned %s for release %s", resp.Status, mbid)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
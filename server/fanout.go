@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/seanbreckenridge/currently_listening"
+	"github.com/seanbreckenridge/currently_listening/agents"
+)
+
+// buildAgents constructs every scrobble agent enabled via CLI flags/env vars.
+func buildAgents(lastfmAPIKey, lastfmAPISecret, lastfmSessionKey, malojaURL, malojaAPIKey string) []currently_listening.Agent {
+	var enabled []currently_listening.Agent
+	if lastfmAPIKey != "" && lastfmAPISecret != "" && lastfmSessionKey != "" {
+		enabled = append(enabled, agents.NewLastFMAgent(lastfmAPIKey, lastfmAPISecret, lastfmSessionKey))
+	}
+	if malojaURL != "" {
+		enabled = append(enabled, agents.NewMalojaAgent(malojaURL, malojaAPIKey))
+	}
+	return enabled
+}
+
+// fanOutNowPlaying notifies every enabled agent that song has started
+// playing. Songs without an artist are skipped, since most agents reject them.
+func fanOutNowPlaying(enabled []currently_listening.Agent, song currently_listening.SetListening) {
+	if song.Artist == "" {
+		return
+	}
+	for _, a := range enabled {
+		a := a
+		go func() {
+			if err := withRetry(func() error { return a.NowPlaying(song) }); err != nil {
+				fmt.Printf("Error sending now playing to %s: %s\n", a.Name(), err.Error())
+			}
+		}()
+	}
+}
+
+// fanOutScrobble notifies every enabled agent that song finished playing at
+// endedAt, with the same empty-artist skip as fanOutNowPlaying.
+func fanOutScrobble(enabled []currently_listening.Agent, song currently_listening.SetListening, endedAt int64) {
+	if song.Artist == "" {
+		return
+	}
+	for _, a := range enabled {
+		a := a
+		go func() {
+			if err := withRetry(func() error { return a.Scrobble(song, endedAt) }); err != nil {
+				fmt.Printf("Error scrobbling to %s: %s\n", a.Name(), err.Error())
+			}
+		}()
+	}
+}
+
+// withRetry retries fn with exponential backoff while it returns
+// agents.ErrRetryLater (a 5xx from the remote service), giving up after a
+// handful of attempts.
+func withRetry(fn func() error) error {
+	backoff := time.Second
+	var err error
+	for attempt := 0; attempt <= 5; attempt++ {
+		err = fn()
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, agents.ErrRetryLater) {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	return err
+}
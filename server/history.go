@@ -0,0 +1,214 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/seanbreckenridge/currently_listening"
+
+	_ "modernc.org/sqlite"
+)
+
+// HistoryEntry is a single play recorded by the server, with EndedAt left
+// nil while the song is still playing.
+type HistoryEntry struct {
+	ID          int64  `json:"id"`
+	Artist      string `json:"artist"`
+	Album       string `json:"album"`
+	Title       string `json:"title"`
+	Base64Image string `json:"base64_image,omitempty"`
+	StartedAt   int64  `json:"started_at"`
+	EndedAt     *int64 `json:"ended_at"`
+}
+
+// Stat is a single row of a top artists/albums/tracks breakdown.
+type Stat struct {
+	Name         string `json:"name"`
+	ListenCount  int    `json:"listen_count"`
+	SecondsSpent int64  `json:"seconds_spent"`
+}
+
+// StatsResponse is returned by GET /stats.
+type StatsResponse struct {
+	Window       string `json:"window"`
+	TotalSeconds int64  `json:"total_seconds"`
+	TopArtists   []Stat `json:"top_artists"`
+	TopAlbums    []Stat `json:"top_albums"`
+	TopTracks    []Stat `json:"top_tracks"`
+}
+
+// HistoryStore persists every SetListening/ClearListening event to a local
+// SQLite database, so the server can answer history/stats queries without
+// relying on an external scrobble service.
+type HistoryStore struct {
+	db *sql.DB
+}
+
+// NewHistoryStore opens (creating if necessary) the SQLite database at path
+// and ensures the history table exists.
+func NewHistoryStore(path string) (*HistoryStore, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS history (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			artist TEXT NOT NULL,
+			album TEXT NOT NULL,
+			title TEXT NOT NULL,
+			base64_image TEXT,
+			started_at INTEGER NOT NULL,
+			ended_at INTEGER
+		)
+	`); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &HistoryStore{db: db}, nil
+}
+
+func (h *HistoryStore) Close() error {
+	return h.db.Close()
+}
+
+// RecordStart opens a new history entry for a SetListening event.
+func (h *HistoryStore) RecordStart(cur currently_listening.SetListening) error {
+	_, err := h.db.Exec(
+		`INSERT INTO history (artist, album, title, base64_image, started_at, ended_at) VALUES (?, ?, ?, ?, ?, NULL)`,
+		cur.Artist, cur.Album, cur.Title, cur.Base64Image, cur.StartedAt,
+	)
+	return err
+}
+
+// RecordEnd closes out the most recently opened history entry (ended_at IS
+// NULL) by setting its ended_at. Only the single most recent open row is
+// targeted, not every open row, so a stale orphan left behind by a server
+// restart mid-song doesn't get closed out (and its duration counted) along
+// with the real previous entry on the next song change.
+func (h *HistoryStore) RecordEnd(endedAt int64) error {
+	_, err := h.db.Exec(
+		`UPDATE history SET ended_at = ? WHERE id = (SELECT id FROM history WHERE ended_at IS NULL ORDER BY started_at DESC LIMIT 1)`,
+		endedAt,
+	)
+	return err
+}
+
+// Query returns history entries matching the given filters, most recent
+// first. A zero `to` means "now" (no upper bound); an empty artist means
+// "any artist".
+func (h *HistoryStore) Query(from, to int64, artist string, limit int) ([]HistoryEntry, error) {
+	query := `SELECT id, artist, album, title, base64_image, started_at, ended_at FROM history WHERE started_at >= ?`
+	args := []interface{}{from}
+	if to > 0 {
+		query += ` AND started_at <= ?`
+		args = append(args, to)
+	}
+	if artist != "" {
+		query += ` AND artist = ?`
+		args = append(args, artist)
+	}
+	query += ` ORDER BY started_at DESC LIMIT ?`
+	args = append(args, limit)
+
+	rows, err := h.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []HistoryEntry{}
+	for rows.Next() {
+		var e HistoryEntry
+		if err := rows.Scan(&e.ID, &e.Artist, &e.Album, &e.Title, &e.Base64Image, &e.StartedAt, &e.EndedAt); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// windowStart returns the unix timestamp `window` seconds back from now,
+// or an error if window isn't one of the accepted values.
+func windowStart(window string, now int64) (int64, error) {
+	switch window {
+	case "day":
+		return now - 86400, nil
+	case "week":
+		return now - 7*86400, nil
+	case "month":
+		return now - 30*86400, nil
+	case "year":
+		return now - 365*86400, nil
+	default:
+		return 0, fmt.Errorf("unknown window %q, expected one of day, week, month, year", window)
+	}
+}
+
+// Stats summarizes listening history over the given window: total time
+// spent listening, and the top artists/albums/tracks by listen count.
+func (h *HistoryStore) Stats(window string, now int64) (*StatsResponse, error) {
+	from, err := windowStart(window, now)
+	if err != nil {
+		return nil, err
+	}
+
+	totalSeconds, err := h.totalSeconds(from, now)
+	if err != nil {
+		return nil, err
+	}
+	topArtists, err := h.topStat("artist", from, now)
+	if err != nil {
+		return nil, err
+	}
+	topAlbums, err := h.topStat("album", from, now)
+	if err != nil {
+		return nil, err
+	}
+	topTracks, err := h.topStat("title", from, now)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StatsResponse{
+		Window:       window,
+		TotalSeconds: totalSeconds,
+		TopArtists:   topArtists,
+		TopAlbums:    topAlbums,
+		TopTracks:    topTracks,
+	}, nil
+}
+
+func (h *HistoryStore) totalSeconds(from, to int64) (int64, error) {
+	var total sql.NullInt64
+	err := h.db.QueryRow(
+		`SELECT SUM(COALESCE(ended_at, ?) - started_at) FROM history WHERE started_at >= ? AND started_at <= ?`,
+		to, from, to,
+	).Scan(&total)
+	if err != nil {
+		return 0, err
+	}
+	return total.Int64, nil
+}
+
+func (h *HistoryStore) topStat(column string, from, to int64) ([]Stat, error) {
+	// column is always one of a fixed set of string literals we control, never user input
+	rows, err := h.db.Query(fmt.Sprintf(
+		`SELECT %s, COUNT(*), SUM(COALESCE(ended_at, ?) - started_at) FROM history WHERE started_at >= ? AND started_at <= ? GROUP BY %s ORDER BY COUNT(*) DESC LIMIT 10`,
+		column, column,
+	), to, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := []Stat{}
+	for rows.Next() {
+		var s Stat
+		if err := rows.Scan(&s.Name, &s.ListenCount, &s.SecondsSpent); err != nil {
+			return nil, err
+		}
+		stats = append(stats, s)
+	}
+	return stats, rows.Err()
+}
@@ -9,7 +9,10 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 type CurrentlyListeningResponse struct {
@@ -22,7 +25,19 @@ type WebsocketResponse struct {
 	Data    interface{} `json:"data"`
 }
 
-func server(port int, password string) {
+func server(port int, password string, dbPath string, sourcePriorities map[string]int, coverArtDir string, scrobbleAgents []currently_listening.Agent) {
+	history, err := NewHistoryStore(dbPath)
+	if err != nil {
+		log.Fatalf("Error opening history database at %s: %s\n", dbPath, err.Error())
+	}
+
+	sources := currently_listening.NewSourceRegistry(defaultSourceTTL)
+
+	coverArt, err := NewCoverArtFetcher(coverArtDir, defaultCoverArtNegativeTTL)
+	if err != nil {
+		log.Fatalf("Error creating cover art cache at %s: %s\n", coverArtDir, err.Error())
+	}
+
 	m := melody.New()
 	m.HandleConnect(func(s *melody.Session) {
 		log.Printf("Opened connection from %s\n", s.Request.RemoteAddr)
@@ -40,12 +55,17 @@ func server(port int, password string) {
 	var isCurrentlyPlaying bool
 
 	currentlyListeningJSON := func() ([]byte, error) {
+		lock.RLock()
+		song := currentlyListeningSong
+		playing := isCurrentlyPlaying
+		lock.RUnlock()
+
 		songBytes, err := json.Marshal(
 			WebsocketResponse{
 				MsgType: "currently-listening",
 				Data: CurrentlyListeningResponse{
-					Song:    currentlyListeningSong,
-					Playing: isCurrentlyPlaying,
+					Song:    song,
+					Playing: playing,
 				},
 			},
 		)
@@ -64,6 +84,20 @@ func server(port int, password string) {
 				fmt.Println("Error marshalling currently listening song to JSON")
 				s.Write([]byte("Error converting currently listening song to JSON"))
 			}
+		case "history":
+			entries, err := history.Query(0, 0, "", 50)
+			if err != nil {
+				fmt.Printf("Error querying history: %s\n", err.Error())
+				s.Write([]byte("Error querying history"))
+				return
+			}
+			historyBytes, err := json.Marshal(WebsocketResponse{MsgType: "history", Data: entries})
+			if err != nil {
+				fmt.Println("Error marshalling history to JSON")
+				s.Write([]byte("Error converting history to JSON"))
+				return
+			}
+			s.Write(historyBytes)
 		case "ping":
 			jsonBytes, err := json.Marshal(
 				WebsocketResponse{
@@ -121,26 +155,85 @@ func server(port int, password string) {
 		}
 
 		// check if currently playing song is newer
-		if currentlyListeningSong != nil && currentTimeStamp != nil && cur.StartedAt < *currentTimeStamp {
-			msg := fmt.Sprintf("cannot set currently playing song, started before latest known timestamp (started at %d, latest timestamp %d)", cur.StartedAt, *currentTimeStamp)
+		lock.RLock()
+		stale := currentlyListeningSong != nil && currentTimeStamp != nil && cur.StartedAt < *currentTimeStamp
+		latestTimestamp := currentTimeStamp
+		lock.RUnlock()
+		if stale {
+			msg := fmt.Sprintf("cannot set currently playing song, started before latest known timestamp (started at %d, latest timestamp %d)", cur.StartedAt, *latestTimestamp)
 			fmt.Println(msg)
 			w.WriteHeader(http.StatusBadRequest)
 			w.Write([]byte(msg))
 			return
 		}
 
-		// set currently playing
+		// resolve conflicts between simultaneous sources by priority, ties broken by recency
+		source := resolveSourceName(cur.Source)
+		priority := sourcePriority(sourcePriorities, source)
+		if !sources.Heartbeat(source, cur.SourceInstance, priority, time.Now().Unix(), cur.StartedAt) {
+			msg := fmt.Sprintf("ignoring set-listening from lower-priority source %q, a higher-priority source is currently active", source)
+			fmt.Println(msg)
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(msg))
+			return
+		}
+
+		// if a song was already playing, close out its history entry and scrobble it before opening a new one
 		lock.Lock()
+		previousSong := currentlyListeningSong
 		currentlyListeningSong = &cur
 		currentTimeStamp = &cur.StartedAt
 		isCurrentlyPlaying = true
 		lock.Unlock()
 
+		if previousSong != nil {
+			if err := history.RecordEnd(cur.StartedAt); err != nil {
+				fmt.Printf("Error closing out previous history entry: %s\n", err.Error())
+			}
+			fanOutScrobble(scrobbleAgents, *previousSong, cur.StartedAt)
+		}
+		if err := history.RecordStart(cur); err != nil {
+			fmt.Printf("Error recording history entry: %s\n", err.Error())
+		}
+
+		fanOutNowPlaying(scrobbleAgents, cur)
+
+		// if no image was submitted, enrich it in the background via MusicBrainz/CoverArtArchive
+		// so a slow external lookup doesn't hold up this request
+		if cur.Base64Image == "" && cur.Artist != "" {
+			startedAt := cur.StartedAt
+			go func(artist, album string) {
+				key, ok, err := coverArt.Fetch(artist, album)
+				if err != nil {
+					fmt.Printf("Error fetching cover art for '%s' - '%s': %s\n", artist, album, err.Error())
+					return
+				}
+				if !ok {
+					return
+				}
+
+				lock.Lock()
+				// only apply if this is still the currently playing song
+				if currentlyListeningSong != nil && currentlyListeningSong.StartedAt == startedAt {
+					currentlyListeningSong.CoverURL = fmt.Sprintf("/cover/%s.jpg", key)
+				}
+				lock.Unlock()
+
+				if sendBody, err := currentlyListeningJSON(); err == nil {
+					m.Broadcast(sendBody)
+				}
+			}(cur.Artist, cur.Album)
+		}
+
 		if sendBody, err := currentlyListeningJSON(); err == nil {
 			// broadcast to all clients
 			m.Broadcast(sendBody)
 			// respond to POST request
-			msg := fmt.Sprintf("Set currently playing song to Artist: '%s', Album: '%s', Title: '%s', Image '%s'", cur.Artist, cur.Album, cur.Title, cur.Base64Image[0:10])
+			imagePreviewLen := len(cur.Base64Image)
+			if imagePreviewLen > 10 {
+				imagePreviewLen = 10
+			}
+			msg := fmt.Sprintf("Set currently playing song to Artist: '%s', Album: '%s', Title: '%s', Image '%s'", cur.Artist, cur.Album, cur.Title, cur.Base64Image[:imagePreviewLen])
 			fmt.Println(msg)
 			w.Write([]byte(msg))
 		} else {
@@ -163,21 +256,34 @@ func server(port int, password string) {
 		}
 
 		// check if clear-playing request is newer than current timestamp
-		if currentTimeStamp != nil && cur.EndedAt < *currentTimeStamp {
-			msg := fmt.Sprintf("cannot clear currently playing song, started before latest known timestamp (started at %d, latest timestamp %d)", cur.EndedAt, *currentTimeStamp)
+		lock.RLock()
+		stale := currentTimeStamp != nil && cur.EndedAt < *currentTimeStamp
+		latestTimestamp := currentTimeStamp
+		lock.RUnlock()
+		if stale {
+			msg := fmt.Sprintf("cannot clear currently playing song, started before latest known timestamp (started at %d, latest timestamp %d)", cur.EndedAt, *latestTimestamp)
 			fmt.Println(msg)
 			w.WriteHeader(http.StatusBadRequest)
 			w.Write([]byte(msg))
 			return
 		}
 
+		if err := history.RecordEnd(cur.EndedAt); err != nil {
+			fmt.Printf("Error closing out history entry: %s\n", err.Error())
+		}
+
 		// unset currently playing
 		lock.Lock()
+		previousSong := currentlyListeningSong
 		currentlyListeningSong = nil
 		currentTimeStamp = &cur.EndedAt
 		isCurrentlyPlaying = false
 		lock.Unlock()
 
+		if previousSong != nil {
+			fanOutScrobble(scrobbleAgents, *previousSong, cur.EndedAt)
+		}
+
 		if sendBody, err := currentlyListeningJSON(); err == nil {
 			// broadcast to all clients
 			m.Broadcast(sendBody)
@@ -190,10 +296,105 @@ func server(port int, password string) {
 		}
 	})
 
+	http.HandleFunc("/history", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+
+		from, err := parseUnixParam(q.Get("from"), 0)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("invalid from: %s", err.Error())))
+			return
+		}
+		to, err := parseUnixParam(q.Get("to"), 0)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("invalid to: %s", err.Error())))
+			return
+		}
+		limit := 100
+		if l := q.Get("limit"); l != "" {
+			parsed, err := strconv.Atoi(l)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(fmt.Sprintf("invalid limit: %s", err.Error())))
+				return
+			}
+			limit = parsed
+		}
+
+		entries, err := history.Query(from, to, q.Get("artist"), limit)
+		if err != nil {
+			handleError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entries)
+	})
+
+	http.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		window := r.URL.Query().Get("window")
+		if window == "" {
+			window = "week"
+		}
+		stats, err := history.Stats(window, time.Now().Unix())
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats)
+	})
+
+	http.HandleFunc("/cover/", func(w http.ResponseWriter, r *http.Request) {
+		hash := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/cover/"), ".jpg")
+		if hash == "" || strings.ContainsAny(hash, "/.") {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("invalid cover art hash"))
+			return
+		}
+		http.ServeFile(w, r, coverArt.Path(hash))
+	})
+
+	http.HandleFunc("/sources", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sources.Active(time.Now().Unix()))
+	})
+
+	http.HandleFunc("/source-heartbeat", func(w http.ResponseWriter, r *http.Request) {
+		if !authdPost(w, r) {
+			return
+		}
+
+		var beat currently_listening.SourceHeartbeat
+		if err := json.NewDecoder(r.Body).Decode(&beat); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("error parsing JSON body"))
+			return
+		}
+
+		source := resolveSourceName(beat.Source)
+		// keeps a source's registration alive independent of whether the song has
+		// changed, so long-playing songs don't make the registry think the
+		// higher-priority source has gone stale
+		now := time.Now().Unix()
+		sources.Heartbeat(source, beat.SourceInstance, sourcePriority(sourcePriorities, source), now, now)
+		w.Write([]byte("ok"))
+	})
+
 	fmt.Printf("Listening on port %d\n", port)
 	http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
 }
 
+// parseUnixParam parses a query parameter as a unix timestamp, returning
+// def if the parameter is empty.
+func parseUnixParam(raw string, def int64) (int64, error) {
+	if raw == "" {
+		return def, nil
+	}
+	return strconv.ParseInt(raw, 10, 64)
+}
+
 func main() {
 
 	app := &cli.App{
@@ -212,11 +413,65 @@ func main() {
 				Required: true,
 				EnvVars:  []string{"CURRENTLY_LISTENING_PASSWORD"},
 			},
+			&cli.StringFlag{
+				Name:    "db",
+				Value:   "currently_listening.db",
+				Usage:   "Path to the SQLite database used to persist listening history",
+				EnvVars: []string{"CURRENTLY_LISTENING_DB"},
+			},
+			&cli.StringFlag{
+				Name:    "source-priority",
+				Value:   "",
+				Usage:   "Comma-separated source=priority pairs (e.g. 'listenbrainz=10,mpris=5') used to resolve conflicts between simultaneous sources. Unlisted sources default to priority 0",
+				EnvVars: []string{"CURRENTLY_LISTENING_SOURCE_PRIORITY"},
+			},
+			&cli.StringFlag{
+				Name:    "cover-art-dir",
+				Value:   "cover_art_cache",
+				Usage:   "Directory to cache cover art fetched from MusicBrainz/CoverArtArchive",
+				EnvVars: []string{"CURRENTLY_LISTENING_COVER_ART_DIR"},
+			},
+			&cli.StringFlag{
+				Name:    "lastfm-api-key",
+				Value:   "",
+				Usage:   "Last.fm API key, enables scrobbling to Last.fm (requires lastfm-api-secret and lastfm-session-key too)",
+				EnvVars: []string{"LASTFM_API_KEY"},
+			},
+			&cli.StringFlag{
+				Name:    "lastfm-api-secret",
+				Value:   "",
+				Usage:   "Last.fm API shared secret, used to sign requests",
+				EnvVars: []string{"LASTFM_API_SECRET"},
+			},
+			&cli.StringFlag{
+				Name:    "lastfm-session-key",
+				Value:   "",
+				Usage:   "Last.fm session key, obtained once via the auth-token handshake (see the agents.LastFMAgent GetToken/GetSession helpers)",
+				EnvVars: []string{"LASTFM_SESSION_KEY"},
+			},
+			&cli.StringFlag{
+				Name:    "maloja-url",
+				Value:   "",
+				Usage:   "Base URL of a Maloja instance, enables scrobbling to Maloja (e.g. https://maloja.example.com)",
+				EnvVars: []string{"MALOJA_URL"},
+			},
+			&cli.StringFlag{
+				Name:    "maloja-api-key",
+				Value:   "",
+				Usage:   "Maloja API key",
+				EnvVars: []string{"MALOJA_API_KEY"},
+			},
 		},
 		Action: func(c *cli.Context) error {
 			port := c.Int("port")
 			pw := c.String("password")
-			server(port, pw)
+			db := c.String("db")
+			sourcePriorities, err := parseSourcePriorities(c.String("source-priority"))
+			if err != nil {
+				return err
+			}
+			scrobbleAgents := buildAgents(c.String("lastfm-api-key"), c.String("lastfm-api-secret"), c.String("lastfm-session-key"), c.String("maloja-url"), c.String("maloja-api-key"))
+			server(port, pw, db, sourcePriorities, c.String("cover-art-dir"), scrobbleAgents)
 			return nil
 		},
 	}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// defaultSourcePriority is used for any source that doesn't have an
+// explicit priority configured.
+const defaultSourcePriority = 0
+
+// defaultSourceTTL is how long a source can go without heartbeating before
+// it's considered stale and no longer counted as "active".
+const defaultSourceTTL = int64(120)
+
+// parseSourcePriorities parses a "source=priority,source=priority" flag
+// value (e.g. "listenbrainz=10,mpris=5") into a lookup table.
+func parseSourcePriorities(raw string) (map[string]int, error) {
+	priorities := map[string]int{}
+	if raw == "" {
+		return priorities, nil
+	}
+	for _, pair := range strings.Split(raw, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid source priority %q, expected source=priority", pair)
+		}
+		priority, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid priority for source %q: %s", parts[0], err.Error())
+		}
+		priorities[strings.TrimSpace(parts[0])] = priority
+	}
+	return priorities, nil
+}
+
+// sourcePriority looks up the configured priority for source, falling back
+// to defaultSourcePriority for sources without an explicit entry.
+func sourcePriority(priorities map[string]int, source string) int {
+	if priority, ok := priorities[source]; ok {
+		return priority
+	}
+	return defaultSourcePriority
+}
+
+// resolveSourceName fills in "unknown" for a request that didn't specify a
+// source, so the SourceRegistry always has a non-empty key to track.
+func resolveSourceName(source string) string {
+	if source == "" {
+		return "unknown"
+	}
+	return source
+}